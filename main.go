@@ -3,21 +3,283 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"strings"
 	"text/template"
 
-	"github.com/golang/protobuf/proto"
-	"github.com/golang/protobuf/protoc-gen-go/descriptor"
-	plugin "github.com/golang/protobuf/protoc-gen-go/plugin"
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
 )
 
-var messages = make(map[string]*descriptor.DescriptorProto)
+var messages = make(map[string]*descriptorpb.DescriptorProto)
+var enums = make(map[string]*descriptorpb.EnumDescriptorProto)
 
-const blueprint = `
+// enumNames maps an enum's fully qualified proto name (e.g.
+// ".trpc.Match.Status") to the TS identifier it's emitted under. Nested
+// enums are qualified by their enclosing message so that two messages
+// each declaring their own nested `Status` don't collide at the top
+// level of the generated file.
+var enumNames = make(map[string]string)
+
+// config holds the options passed via --twirp-es_opt=k=v,k=v.
+type config struct {
+	// Transport controls how the request/response body of every
+	// generated method is encoded on the wire: json (default), protobuf
+	// or auto.
+	Transport string
+	// Tracing controls whether generated methods open an OpenTelemetry
+	// span and propagate it via a W3C traceparent header: none
+	// (default) or otel.
+	Tracing string
+	// Errors controls how a method reports a non-2xx Twirp response:
+	// throw (default) rejects with a TwirpError, result resolves with a
+	// discriminated Result<T> instead.
+	Errors string
+}
+
+func parseConfig(parameter string) config {
+	cfg := config{Transport: "json", Tracing: "none", Errors: "throw"}
+	for _, kv := range strings.Split(parameter, ",") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "transport":
+			cfg.Transport = parts[1]
+		case "tracing":
+			cfg.Tracing = parts[1]
+		case "errors":
+			cfg.Errors = parts[1]
+		}
+	}
+	return cfg
+}
+
+// otelRuntime is emitted once per generated file when tracing is
+// enabled. withSpan opens a span around a single RPC, injects the
+// resulting traceparent so the call stitches into server-side spans,
+// and records any thrown error before closing the span.
+const otelRuntime = `
+import { trace, SpanStatusCode, Span } from '@opentelemetry/api'
+
+const tracer = trace.getTracer('twirp-es')
+
+async function withSpan<T>(name: string, attributes: Record<string, string>, fn: (traceparent: string, span: Span) => Promise<T>): Promise<T> {
+	return tracer.startActiveSpan(name, async (span) => {
+		for (const [key, value] of Object.entries(attributes)) {
+			span.setAttribute(key, value)
+		}
+		const spanContext = span.spanContext()
+		const traceparent = ` + "`00-${spanContext.traceId}-${spanContext.spanId}-01`" + `
+		try {
+			return await fn(traceparent, span)
+		} catch (err) {
+			span.recordException(err as Error)
+			span.setStatus({ code: SpanStatusCode.ERROR })
+			throw err
+		} finally {
+			span.end()
+		}
+	})
+}
+
+// recordSpanError marks span as failed without throwing, for errors=result
+// mode where a non-2xx response resolves to an errResult instead of
+// unwinding through withSpan's own catch block.
+function recordSpanError(span: Span, error: Error) {
+	span.recordException(error)
+	span.setStatus({ code: SpanStatusCode.ERROR })
+}
+`
+
+// twirpErrorCodes are the canonical Twirp error codes, see
+// https://twitchtv.github.io/twirp/docs/spec_v7.html#error-codes.
+var twirpErrorCodes = []string{
+	"canceled",
+	"unknown",
+	"invalid_argument",
+	"malformed",
+	"deadline_exceeded",
+	"not_found",
+	"bad_route",
+	"already_exists",
+	"permission_denied",
+	"unauthenticated",
+	"resource_exhausted",
+	"failed_precondition",
+	"aborted",
+	"out_of_range",
+	"unimplemented",
+	"internal",
+	"unavailable",
+	"dataloss",
+}
+
+// errorClassName turns a Twirp error code such as "invalid_argument" into
+// its generated class name, e.g. InvalidArgumentError.
+func errorClassName(code string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(code, "_") {
+		b.WriteString(capitalize(part))
+	}
+	b.WriteString("Error")
+	return b.String()
+}
+
+// twirpErrorRuntime is emitted once per generated file. It declares a
+// TwirpError base class, a subclass per canonical Twirp error code, and
+// the helpers every blueprint uses to turn a non-2xx fetch Response into
+// the right subclass: parseTwirpError reads the `{code, msg, meta}` body
+// and looks up the matching class, throwTwirpError is used when
+// errors=throw, and okResult/errResult build a Result<T> when
+// errors=result.
+func twirpErrorRuntime() string {
+	var b strings.Builder
+	b.WriteString(`
+export type TwirpErrorCode =
+`)
+	for i, code := range twirpErrorCodes {
+		sep := "|"
+		if i == 0 {
+			sep = " "
+		}
+		fmt.Fprintf(&b, "  %s '%s'\n", sep, code)
+	}
+	b.WriteString(`
+export class TwirpError extends Error {
+  constructor(public code: TwirpErrorCode, message: string, public meta: Record<string, string> = {}) {
+    super(message)
+    this.name = 'TwirpError'
+  }
+}
+`)
+	for _, code := range twirpErrorCodes {
+		fmt.Fprintf(&b, `
+export class %s extends TwirpError {
+  constructor(message: string, meta: Record<string, string> = {}) {
+    super('%s', message, meta)
+    this.name = '%s'
+  }
+}
+`, errorClassName(code), code, errorClassName(code))
+	}
+
+	b.WriteString("\nconst twirpErrorClasses: Record<string, new (message: string, meta: Record<string, string>) => TwirpError> = {\n")
+	for _, code := range twirpErrorCodes {
+		fmt.Fprintf(&b, "  %s: %s,\n", code, errorClassName(code))
+	}
+	b.WriteString(`}
+
+async function parseTwirpError(res: Response): Promise<TwirpError> {
+  const body = await res.json().catch(() => ({})) as { code?: string, msg?: string, meta?: Record<string, string> }
+  const ErrorClass = (body.code && twirpErrorClasses[body.code]) || TwirpError
+  if (ErrorClass === TwirpError) {
+    return new TwirpError((body.code as TwirpErrorCode) || 'unknown', body.msg || res.statusText, body.meta || {})
+  }
+  return new ErrorClass(body.msg || res.statusText, body.meta || {})
+}
+
+async function throwTwirpError(res: Response): Promise<never> {
+  throw await parseTwirpError(res)
+}
+
+export type Result<T> = { ok: true, value: T } | { ok: false, error: TwirpError }
+
+function okResult<T>(value: T): Result<T> {
+  return { ok: true, value }
+}
+
+function errResult<T>(error: TwirpError): Result<T> {
+  return { ok: false, error }
+}
+`)
+	return b.String()
+}
+
+// streamMethod is shared by every transport: a streaming method always
+// reads newline-delimited JSON frames off the response body, regardless
+// of which transport is used to encode the request.
+const streamMethod = `{{define "stream"}}
+export async function* {{.Name}}(input: {{.InputType}}): AsyncIterable<{{.OutputType}}> {
+	const meta = document.querySelector('meta[name="csrf-token"]') as HTMLMetaElement
+	const token = meta.content
+	const res = await fetch('/twirp/trpc.{{.Service}}/{{.Name}}', {
+		headers: {
+			'X-CSRF-Token': token,
+			'Content-Type': 'application/json'
+		},
+		credentials: 'same-origin',
+		method: 'POST',
+		body: JSON.stringify(input)
+	})
+	if (res.status !== 200) {
+		await throwTwirpError(res)
+	}
+	if (!res.body) {
+		return
+	}
+	const reader = res.body.pipeThrough(new TextDecoderStream()).getReader()
+	let buffer = ''
+	while (true) {
+		const { value, done } = await reader.read()
+		if (done) {
+			break
+		}
+		buffer += value
+		let index: number
+		while ((index = buffer.indexOf('\n')) !== -1) {
+			const line = buffer.slice(0, index)
+			buffer = buffer.slice(index + 1)
+			if (line.trim() !== '') {
+				yield new {{.OutputType}}(JSON.parse(line))
+			}
+		}
+	}
+}
+{{end}}`
+
+const jsonBlueprint = streamMethod + `
 {{- range $i, $method := .Methods}}
-export const {{.Name}} = async (input: {{.InputType}}): Promise<{{.OutputType}}> => {
+{{- if .Streaming}}
+{{template "stream" .}}
+{{- else}}
+export const {{.Name}} = async (input: {{.InputType}}): Promise<{{if $.ResultMode}}Result<{{.OutputType}}>{{else}}{{.OutputType}}{{end}}> => {
+{{- if $.Tracing}}
+	return withSpan('{{.Service}}.{{.Name}}', {{"{"}} 'rpc.system': 'twirp', 'rpc.service': '{{.Service}}', 'rpc.method': '{{.Name}}' {{"}"}}, async (traceparent, span) => {
+		const meta = document.querySelector('meta[name="csrf-token"]') as HTMLMetaElement
+		const token = meta.content
+		const res = await fetch('/twirp/trpc.{{.Service}}/{{.Name}}', {
+			headers: {
+				'X-CSRF-Token': token,
+				'Content-Type': 'application/json',
+				'traceparent': traceparent
+			},
+			credentials: 'same-origin',
+			method: 'POST',
+			body: JSON.stringify(input)
+		})
+		span.setAttribute('http.status_code', res.status)
+{{- if $.ResultMode}}
+		if (res.status !== 200) {
+			const error = await parseTwirpError(res)
+			recordSpanError(span, error)
+			return errResult(error)
+		}
+		const data = await res.json()
+		return okResult(new {{.OutputType}}(data))
+{{- else}}
+		if (res.status !== 200) {
+			await throwTwirpError(res)
+		}
+		const data = await res.json()
+		return new {{.OutputType}}(data)
+{{- end}}
+	})
+{{- else}}
 	const meta = document.querySelector('meta[name="csrf-token"]') as HTMLMetaElement
 	const token = meta.content
 	const res = await fetch('/twirp/trpc.{{.Service}}/{{.Name}}', {
@@ -29,12 +291,184 @@ export const {{.Name}} = async (input: {{.InputType}}): Promise<{{.OutputType}}>
 		method: 'POST',
 		body: JSON.stringify(input)
 	})
+{{- if $.ResultMode}}
+	if (res.status !== 200) {
+		return errResult(await parseTwirpError(res))
+	}
+	const data = await res.json()
+	return okResult(new {{.OutputType}}(data))
+{{- else}}
 	if (res.status !== 200) {
-		throw new Error(res.statusText)
+		await throwTwirpError(res)
 	}
 	const data = await res.json()
 	return new {{.OutputType}}(data)
+{{- end}}
+{{- end}}
+}
+{{- end}}
+{{end}}
+`
+
+const protobufBlueprint = streamMethod + `
+{{- range $i, $method := .Methods}}
+{{- if .Streaming}}
+{{template "stream" .}}
+{{- else}}
+export const {{.Name}} = async (input: {{.InputType}}): Promise<{{if $.ResultMode}}Result<{{.OutputType}}>{{else}}{{.OutputType}}{{end}}> => {
+{{- if $.Tracing}}
+	return withSpan('{{.Service}}.{{.Name}}', {{"{"}} 'rpc.system': 'twirp', 'rpc.service': '{{.Service}}', 'rpc.method': '{{.Name}}' {{"}"}}, async (traceparent, span) => {
+		const meta = document.querySelector('meta[name="csrf-token"]') as HTMLMetaElement
+		const token = meta.content
+		const res = await fetch('/twirp/trpc.{{.Service}}/{{.Name}}', {
+			headers: {
+				'X-CSRF-Token': token,
+				'Content-Type': 'application/protobuf',
+				'traceparent': traceparent
+			},
+			credentials: 'same-origin',
+			method: 'POST',
+			body: input.encode()
+		})
+		span.setAttribute('http.status_code', res.status)
+{{- if $.ResultMode}}
+		if (res.status !== 200) {
+			const error = await parseTwirpError(res)
+			recordSpanError(span, error)
+			return errResult(error)
+		}
+		const data = await res.arrayBuffer()
+		return okResult({{.OutputType}}.decode(new Uint8Array(data)))
+{{- else}}
+		if (res.status !== 200) {
+			await throwTwirpError(res)
+		}
+		const data = await res.arrayBuffer()
+		return {{.OutputType}}.decode(new Uint8Array(data))
+{{- end}}
+	})
+{{- else}}
+	const meta = document.querySelector('meta[name="csrf-token"]') as HTMLMetaElement
+	const token = meta.content
+	const res = await fetch('/twirp/trpc.{{.Service}}/{{.Name}}', {
+		headers: {
+			'X-CSRF-Token': token,
+			'Content-Type': 'application/protobuf'
+		},
+		credentials: 'same-origin',
+		method: 'POST',
+		body: input.encode()
+	})
+{{- if $.ResultMode}}
+	if (res.status !== 200) {
+		return errResult(await parseTwirpError(res))
+	}
+	const data = await res.arrayBuffer()
+	return okResult({{.OutputType}}.decode(new Uint8Array(data)))
+{{- else}}
+	if (res.status !== 200) {
+		await throwTwirpError(res)
+	}
+	const data = await res.arrayBuffer()
+	return {{.OutputType}}.decode(new Uint8Array(data))
+{{- end}}
+{{- end}}
 }
+{{- end}}
+{{end}}
+`
+
+// autoBlueprint negotiates the transport at request time: it sends
+// protobuf (the cheaper encoding) but falls back to parsing whatever
+// content type the server actually answers with, so clients keep
+// working against Twirp servers that only speak JSON.
+const autoBlueprint = streamMethod + `
+{{- range $i, $method := .Methods}}
+{{- if .Streaming}}
+{{template "stream" .}}
+{{- else}}
+export const {{.Name}} = async (input: {{.InputType}}): Promise<{{if $.ResultMode}}Result<{{.OutputType}}>{{else}}{{.OutputType}}{{end}}> => {
+{{- if $.Tracing}}
+	return withSpan('{{.Service}}.{{.Name}}', {{"{"}} 'rpc.system': 'twirp', 'rpc.service': '{{.Service}}', 'rpc.method': '{{.Name}}' {{"}"}}, async (traceparent, span) => {
+		const meta = document.querySelector('meta[name="csrf-token"]') as HTMLMetaElement
+		const token = meta.content
+		const res = await fetch('/twirp/trpc.{{.Service}}/{{.Name}}', {
+			headers: {
+				'X-CSRF-Token': token,
+				'Content-Type': 'application/protobuf',
+				'Accept': 'application/protobuf, application/json',
+				'traceparent': traceparent
+			},
+			credentials: 'same-origin',
+			method: 'POST',
+			body: input.encode()
+		})
+		span.setAttribute('http.status_code', res.status)
+{{- if $.ResultMode}}
+		if (res.status !== 200) {
+			const error = await parseTwirpError(res)
+			recordSpanError(span, error)
+			return errResult(error)
+		}
+		const contentType = res.headers.get('Content-Type') || ''
+		if (contentType.indexOf('application/json') !== -1) {
+			const data = await res.json()
+			return okResult(new {{.OutputType}}(data))
+		}
+		const data = await res.arrayBuffer()
+		return okResult({{.OutputType}}.decode(new Uint8Array(data)))
+{{- else}}
+		if (res.status !== 200) {
+			await throwTwirpError(res)
+		}
+		const contentType = res.headers.get('Content-Type') || ''
+		if (contentType.indexOf('application/json') !== -1) {
+			const data = await res.json()
+			return new {{.OutputType}}(data)
+		}
+		const data = await res.arrayBuffer()
+		return {{.OutputType}}.decode(new Uint8Array(data))
+{{- end}}
+	})
+{{- else}}
+	const meta = document.querySelector('meta[name="csrf-token"]') as HTMLMetaElement
+	const token = meta.content
+	const res = await fetch('/twirp/trpc.{{.Service}}/{{.Name}}', {
+		headers: {
+			'X-CSRF-Token': token,
+			'Content-Type': 'application/protobuf',
+			'Accept': 'application/protobuf, application/json'
+		},
+		credentials: 'same-origin',
+		method: 'POST',
+		body: input.encode()
+	})
+{{- if $.ResultMode}}
+	if (res.status !== 200) {
+		return errResult(await parseTwirpError(res))
+	}
+	const contentType = res.headers.get('Content-Type') || ''
+	if (contentType.indexOf('application/json') !== -1) {
+		const data = await res.json()
+		return okResult(new {{.OutputType}}(data))
+	}
+	const data = await res.arrayBuffer()
+	return okResult({{.OutputType}}.decode(new Uint8Array(data)))
+{{- else}}
+	if (res.status !== 200) {
+		await throwTwirpError(res)
+	}
+	const contentType = res.headers.get('Content-Type') || ''
+	if (contentType.indexOf('application/json') !== -1) {
+		const data = await res.json()
+		return new {{.OutputType}}(data)
+	}
+	const data = await res.arrayBuffer()
+	return {{.OutputType}}.decode(new Uint8Array(data))
+{{- end}}
+{{- end}}
+}
+{{- end}}
 {{end}}
 `
 
@@ -47,25 +481,303 @@ var classes = []string{
 }
 
 const class = `
-export class {{.Message.GetName}} {
 {{- $Message := .Message -}}
-{{- range $i, $field := .Message.GetField}}
+{{- range .OneofGroups}}
+export type {{.TypeName}} =
+{{- range .Fields}}
+  | { kind: '{{.Name}}', {{.Name}}: {{getTypeScriptType $Message .}} }
+{{- end}}
+
+{{end}}
+export class {{.Message.GetName}} {
+{{- range $i, $field := .Fields}}
   {{.Name}}: {{getTypeScriptType $Message .}}
+{{- end}}
+{{- range .OneofGroups}}
+  {{.Name}}: {{.TypeName}}
 {{- end}}
   constructor(o) {
-    {{- range $i, $field := .Message.GetField}}
+    {{- range $i, $field := .Fields}}
     {{initiate $Message .}}
     {{- end}}
+    {{- range .OneofGroups}}
+    {{oneofInit $Message .}}
+    {{- end}}
+  }
+{{- if .Protobuf}}
+  encode(): Uint8Array {
+    const w = new TwirpWriter()
+    {{- range $i, $field := .Fields}}
+    {{encodeField $Message .}}
+    {{- end}}
+    {{- range .OneofGroups}}
+    {{oneofEncode $Message .}}
+    {{- end}}
+    return w.finish()
+  }
+  static decode(bytes: Uint8Array): {{.Message.GetName}} {
+    const o: any = {}
+    const r = new TwirpReader(bytes)
+    while (r.hasMore()) {
+      const tag = r.readVarint()
+      const field = tag >>> 3
+      switch (field) {
+        {{- range $i, $field := .Fields}}
+        {{decodeField $Message .}}
+        {{- end}}
+        {{- range .OneofGroups}}
+        {{- $oneof := .}}
+        {{- range .Fields}}
+        {{decodeOneofField $Message $oneof.Name .}}
+        {{- end}}
+        {{- end}}
+        default:
+          r.skip(tag & 7)
+      }
+    }
+    return new {{.Message.GetName}}(o)
+  }
+{{- end}}
+}
+`
+
+// twirpWireRuntime is emitted once per generated file when the protobuf
+// transport is enabled. It implements the minimal subset of the
+// protobuf wire format (varints with sign/zigzag handling, 32/64-bit
+// fixed values and length-delimited fields) needed by encode()/decode()
+// on each class. Varints are carried as bigint internally so int64/
+// uint64 values survive the round trip instead of being truncated to 32
+// bits. readPacked() backs decodeField's packed-repeated-scalar case:
+// proto3 encoders pack repeated scalars into a single length-delimited
+// blob by default, rather than repeating the tag per element.
+const twirpWireRuntime = `
+class TwirpWriter {
+  private chunks: Uint8Array[] = []
+  writeVarint(value: number | bigint) {
+    let v = BigInt.asUintN(64, typeof value === 'bigint' ? value : BigInt(Math.trunc(value)))
+    const bytes: number[] = []
+    while (v > 0x7fn) {
+      bytes.push(Number(v & 0x7fn) | 0x80)
+      v >>= 7n
+    }
+    bytes.push(Number(v))
+    this.chunks.push(new Uint8Array(bytes))
+  }
+  writeZigzag(value: number) {
+    const n = BigInt(Math.trunc(value))
+    this.writeVarint((n << 1n) ^ (n >> 63n))
+  }
+  writeFixed32(value: number) {
+    const buf = new ArrayBuffer(4)
+    new DataView(buf).setUint32(0, value, true)
+    this.chunks.push(new Uint8Array(buf))
+  }
+  writeSfixed32(value: number) {
+    const buf = new ArrayBuffer(4)
+    new DataView(buf).setInt32(0, value, true)
+    this.chunks.push(new Uint8Array(buf))
+  }
+  writeFloat(value: number) {
+    const buf = new ArrayBuffer(4)
+    new DataView(buf).setFloat32(0, value, true)
+    this.chunks.push(new Uint8Array(buf))
+  }
+  writeFixed64(value: number) {
+    const buf = new ArrayBuffer(8)
+    new DataView(buf).setBigUint64(0, BigInt.asUintN(64, BigInt(Math.trunc(value))), true)
+    this.chunks.push(new Uint8Array(buf))
+  }
+  writeSfixed64(value: number) {
+    const buf = new ArrayBuffer(8)
+    new DataView(buf).setBigInt64(0, BigInt.asIntN(64, BigInt(Math.trunc(value))), true)
+    this.chunks.push(new Uint8Array(buf))
+  }
+  writeDouble(value: number) {
+    const buf = new ArrayBuffer(8)
+    new DataView(buf).setFloat64(0, value, true)
+    this.chunks.push(new Uint8Array(buf))
+  }
+  writeBytes(value: Uint8Array) {
+    this.writeVarint(value.length)
+    this.chunks.push(value)
+  }
+  writeString(value: string) {
+    this.writeBytes(new TextEncoder().encode(value))
+  }
+  finish(): Uint8Array {
+    const length = this.chunks.reduce((n, c) => n + c.length, 0)
+    const out = new Uint8Array(length)
+    let offset = 0
+    for (const chunk of this.chunks) {
+      out.set(chunk, offset)
+      offset += chunk.length
+    }
+    return out
+  }
+}
+
+class TwirpReader {
+  private offset = 0
+  constructor(private bytes: Uint8Array) {}
+  hasMore(): boolean {
+    return this.offset < this.bytes.length
+  }
+  private readRawVarint(): bigint {
+    let result = 0n
+    let shift = 0n
+    let b: number
+    do {
+      b = this.bytes[this.offset++]
+      result |= BigInt(b & 0x7f) << shift
+      shift += 7n
+    } while (b & 0x80)
+    return result
+  }
+  readVarint(): number {
+    return Number(BigInt.asUintN(64, this.readRawVarint()))
+  }
+  readSignedVarint(): number {
+    return Number(BigInt.asIntN(64, this.readRawVarint()))
+  }
+  readZigzag(): number {
+    const raw = this.readRawVarint()
+    return Number((raw >> 1n) ^ -(raw & 1n))
+  }
+  readFixed32(): number {
+    const value = new DataView(this.bytes.buffer, this.bytes.byteOffset + this.offset, 4).getUint32(0, true)
+    this.offset += 4
+    return value
+  }
+  readSfixed32(): number {
+    const value = new DataView(this.bytes.buffer, this.bytes.byteOffset + this.offset, 4).getInt32(0, true)
+    this.offset += 4
+    return value
+  }
+  readFloat(): number {
+    const value = new DataView(this.bytes.buffer, this.bytes.byteOffset + this.offset, 4).getFloat32(0, true)
+    this.offset += 4
+    return value
+  }
+  readFixed64(): number {
+    const value = new DataView(this.bytes.buffer, this.bytes.byteOffset + this.offset, 8).getBigUint64(0, true)
+    this.offset += 8
+    return Number(value)
+  }
+  readSfixed64(): number {
+    const value = new DataView(this.bytes.buffer, this.bytes.byteOffset + this.offset, 8).getBigInt64(0, true)
+    this.offset += 8
+    return Number(value)
+  }
+  readDouble(): number {
+    const value = new DataView(this.bytes.buffer, this.bytes.byteOffset + this.offset, 8).getFloat64(0, true)
+    this.offset += 8
+    return value
+  }
+  readBytes(): Uint8Array {
+    const length = this.readVarint()
+    const out = this.bytes.slice(this.offset, this.offset + length)
+    this.offset += length
+    return out
+  }
+  readPacked<T>(readOne: () => T): T[] {
+    const length = this.readVarint()
+    const end = this.offset + length
+    const out: T[] = []
+    while (this.offset < end) {
+      out.push(readOne())
+    }
+    return out
+  }
+  readString(): string {
+    return new TextDecoder().decode(this.readBytes())
+  }
+  skip(wireType: number) {
+    if (wireType === 0) {
+      this.readRawVarint()
+    } else if (wireType === 1) {
+      this.offset += 8
+    } else if (wireType === 2) {
+      this.readBytes()
+    } else if (wireType === 5) {
+      this.offset += 4
+    }
   }
 }
 `
 
+// OneofGroup is a proto3 `oneof` (excluding the synthetic oneofs proto3
+// generates for `optional` fields), rendered as a discriminated union.
+type OneofGroup struct {
+	Name     string
+	TypeName string
+	Fields   []*descriptorpb.FieldDescriptorProto
+}
+
+// MessageView is what the `class` template renders. Fields holds every
+// field that is emitted as a regular class property; fields that belong
+// to a real oneof are grouped into OneofGroups instead.
+type MessageView struct {
+	Message     *descriptorpb.DescriptorProto
+	Fields      []*descriptorpb.FieldDescriptorProto
+	OneofGroups []OneofGroup
+	Protobuf    bool
+}
+
+func buildMessageView(message *descriptorpb.DescriptorProto, protobuf bool) MessageView {
+	view := MessageView{Message: message, Protobuf: protobuf}
+	groups := make(map[int32]*OneofGroup)
+	var order []int32
+
+	for _, field := range message.GetField() {
+		if field.OneofIndex != nil && !field.GetProto3Optional() {
+			idx := field.GetOneofIndex()
+			g, ok := groups[idx]
+			if !ok {
+				name := message.GetOneofDecl()[idx].GetName()
+				g = &OneofGroup{Name: name, TypeName: capitalize(name) + "Oneof"}
+				groups[idx] = g
+				order = append(order, idx)
+			}
+			g.Fields = append(g.Fields, field)
+			continue
+		}
+		view.Fields = append(view.Fields, field)
+	}
+
+	for _, idx := range order {
+		view.OneofGroups = append(view.OneofGroups, *groups[idx])
+	}
+	return view
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// emitEnum renders a proto3 enum as a TS enum with the declared values,
+// under name (the qualified name from enumNames so nested enums that
+// share a bare name, e.g. two messages each with their own nested
+// `Status`, don't collide at the top level).
+func emitEnum(enum *descriptorpb.EnumDescriptorProto, name string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "export enum %s {\n", name)
+	for _, v := range enum.GetValue() {
+		fmt.Fprintf(&b, "  %s = %d,\n", v.GetName(), v.GetNumber())
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
 // Method comment
 type Method struct {
 	Service    string
 	Name       string
 	OutputType string
 	InputType  string
+	Streaming  bool
 }
 
 // Methods comment
@@ -103,142 +815,178 @@ func isBuiltIn(name string) bool {
 var funcMap = template.FuncMap{
 	"getTypeScriptType": getTypeScriptType,
 	"initiate":          initiate,
+	"encodeField":       encodeField,
+	"decodeField":       decodeField,
+	"oneofInit":         oneofInit,
+	"oneofEncode":       oneofEncode,
+	"decodeOneofField":  decodeOneofField,
 }
 
 func main() {
-	in, err := ioutil.ReadAll(os.Stdin)
-	if err != nil {
-		panic(err)
-	}
-	req := &plugin.CodeGeneratorRequest{}
-	if err := proto.Unmarshal(in, req); err != nil {
-		panic(err)
-	}
+	protogen.Options{}.Run(func(gen *protogen.Plugin) error {
+		gen.SupportedFeatures |= uint64(pluginpb.CodeGeneratorResponse_FEATURE_PROTO3_OPTIONAL)
+		cfg := parseConfig(gen.Request.GetParameter())
 
-	for _, f := range req.ProtoFile {
-		// messages
-		for _, message := range f.MessageType {
+		for _, f := range gen.Files {
+			fileProto := f.Proto
 
-			if !isBuiltIn(message.GetName()) {
-				parsed := template.Must(template.New("").Funcs(funcMap).Parse(class))
-				data := struct {
-					Message *descriptor.DescriptorProto
-				}{
-					Message: message,
+			// file-level enums
+			for _, enum := range fileProto.GetEnumType() {
+				key := "." + fileProto.GetPackage() + "." + enum.GetName()
+				enums[key] = enum
+				enumNames[key] = enum.GetName()
+				classes = append(classes, emitEnum(enum, enum.GetName()))
+			}
+
+			// messages
+			for _, message := range fileProto.MessageType {
+
+				// nested enums, qualified by the enclosing message name
+				for _, enum := range message.GetEnumType() {
+					key := "." + fileProto.GetPackage() + "." + message.GetName() + "." + enum.GetName()
+					name := message.GetName() + enum.GetName()
+					enums[key] = enum
+					enumNames[key] = name
+					classes = append(classes, emitEnum(enum, name))
 				}
-				var tmp bytes.Buffer
-				if err := parsed.Execute(&tmp, data); err != nil {
-					panic(err)
+
+				if !isBuiltIn(message.GetName()) {
+					parsed := template.Must(template.New("").Funcs(funcMap).Parse(class))
+					view := buildMessageView(message, cfg.Transport != "json")
+					var tmp bytes.Buffer
+					if err := parsed.Execute(&tmp, view); err != nil {
+						return err
+					}
+					classes = append(classes, tmp.String())
 				}
-				classes = append(classes, tmp.String())
-			}
 
-			// generate key, e.g. ".trpc.MatchesPoints"
-			key := "." + f.GetPackage() + "." + message.GetName()
-			messages[key] = message
+				// generate key, e.g. ".trpc.MatchesPoints"
+				key := "." + fileProto.GetPackage() + "." + message.GetName()
+				messages[key] = message
 
-			// get nested types for maps, i.e. <string, Something>
-			for _, t := range message.GetNestedType() {
-				subkey := key + "." + t.GetName()
-				messages[subkey] = t
+				// get nested types for maps, i.e. <string, Something>
+				for _, t := range message.GetNestedType() {
+					subkey := key + "." + t.GetName()
+					messages[subkey] = t
+				}
 			}
-		}
 
-		// services
-		for _, service := range f.Service {
+			// services
+			for _, service := range fileProto.Service {
+
+				// methods
+				for _, method := range service.Method {
 
-			// methods
-			for _, method := range service.Method {
+					outputType := messages[method.GetOutputType()]
+					inputType := messages[method.GetInputType()]
 
-				outputType := messages[method.GetOutputType()]
-				inputType := messages[method.GetInputType()]
+					m := Method{
+						Service:    service.GetName(),
+						Name:       method.GetName(),
+						OutputType: outputType.GetName(),
+						InputType:  inputType.GetName(),
+						Streaming:  isStreaming(method),
+					}
 
-				m := Method{
-					Service:    service.GetName(),
-					Name:       method.GetName(),
-					OutputType: outputType.GetName(),
-					InputType:  inputType.GetName(),
+					Methods = append(Methods, m)
 				}
 
-				Methods = append(Methods, m)
 			}
+		}
 
+		if len(gen.Request.GetFileToGenerate()) == 0 {
+			return nil
 		}
-	}
 
-	parsed := template.Must(template.New("").Parse(blueprint))
-	data := struct {
-		Methods []Method
-	}{
-		Methods: Methods,
-	}
-	var tmp bytes.Buffer
-	if err := parsed.Execute(&tmp, data); err != nil {
-		panic(err)
-	}
+		var blueprint string
+		switch cfg.Transport {
+		case "protobuf":
+			blueprint = protobufBlueprint
+		case "auto":
+			blueprint = autoBlueprint
+		default:
+			blueprint = jsonBlueprint
+		}
 
-	// generate file with functions
-	name := strings.Replace(req.FileToGenerate[0], ".proto", ".ts", -1)
-	content := strings.Join(classes, "") + tmp.String()
-	res := &plugin.CodeGeneratorResponse{}
-	res.File = append(res.File, &plugin.CodeGeneratorResponse_File{
-		Name:    &name,
-		Content: &content,
-	})
+		parsed := template.Must(template.New("").Parse(blueprint))
+		data := struct {
+			Methods    []Method
+			Tracing    bool
+			ResultMode bool
+		}{
+			Methods:    Methods,
+			Tracing:    cfg.Tracing == "otel",
+			ResultMode: cfg.Errors == "result",
+		}
+		var tmp bytes.Buffer
+		if err := parsed.Execute(&tmp, data); err != nil {
+			return err
+		}
 
-	out, err := proto.Marshal(res)
-	if err != nil {
-		panic(err)
-	}
-	if _, err := os.Stdout.Write(out); err != nil {
-		panic(err)
-	}
+		// generate file with functions
+		name := strings.Replace(gen.Request.GetFileToGenerate()[0], ".proto", ".ts", -1)
+		runtime := twirpErrorRuntime()
+		if cfg.Transport != "json" {
+			runtime += twirpWireRuntime
+		}
+		if cfg.Tracing == "otel" {
+			runtime += otelRuntime
+		}
+		content := strings.Join(classes, "") + runtime + tmp.String()
+
+		g := gen.NewGeneratedFile(name, "")
+		if _, err := g.Write([]byte(content)); err != nil {
+			return err
+		}
+		return nil
+	})
 }
 
 // return zero value for primitive type
-func zv(t descriptor.FieldDescriptorProto_Type) string {
+func zv(t descriptorpb.FieldDescriptorProto_Type) string {
 	switch t {
-	case descriptor.FieldDescriptorProto_TYPE_DOUBLE,
-		descriptor.FieldDescriptorProto_TYPE_FLOAT,
-		descriptor.FieldDescriptorProto_TYPE_INT64,
-		descriptor.FieldDescriptorProto_TYPE_UINT64,
-		descriptor.FieldDescriptorProto_TYPE_INT32,
-		descriptor.FieldDescriptorProto_TYPE_FIXED64,
-		descriptor.FieldDescriptorProto_TYPE_FIXED32,
-		descriptor.FieldDescriptorProto_TYPE_UINT32,
-		descriptor.FieldDescriptorProto_TYPE_SFIXED32,
-		descriptor.FieldDescriptorProto_TYPE_SFIXED64,
-		descriptor.FieldDescriptorProto_TYPE_SINT32,
-		descriptor.FieldDescriptorProto_TYPE_SINT64:
+	case descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+		descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+		descriptorpb.FieldDescriptorProto_TYPE_INT64,
+		descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+		descriptorpb.FieldDescriptorProto_TYPE_INT32,
+		descriptorpb.FieldDescriptorProto_TYPE_FIXED64,
+		descriptorpb.FieldDescriptorProto_TYPE_FIXED32,
+		descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+		descriptorpb.FieldDescriptorProto_TYPE_SFIXED32,
+		descriptorpb.FieldDescriptorProto_TYPE_SFIXED64,
+		descriptorpb.FieldDescriptorProto_TYPE_SINT32,
+		descriptorpb.FieldDescriptorProto_TYPE_SINT64,
+		descriptorpb.FieldDescriptorProto_TYPE_ENUM:
 		return "0"
-	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+	case descriptorpb.FieldDescriptorProto_TYPE_BOOL:
 		return "false"
-	case descriptor.FieldDescriptorProto_TYPE_STRING:
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING:
 		return "\"\""
 	default:
 		return "{}"
 	}
 }
 
-func getTypeScriptType(message *descriptor.DescriptorProto, field *descriptor.FieldDescriptorProto) string {
+func getTypeScriptType(message *descriptorpb.DescriptorProto, field *descriptorpb.FieldDescriptorProto) string {
 	var result string
 	switch field.GetType() {
-	case descriptor.FieldDescriptorProto_TYPE_DOUBLE,
-		descriptor.FieldDescriptorProto_TYPE_FLOAT,
-		descriptor.FieldDescriptorProto_TYPE_INT64,
-		descriptor.FieldDescriptorProto_TYPE_UINT64,
-		descriptor.FieldDescriptorProto_TYPE_INT32,
-		descriptor.FieldDescriptorProto_TYPE_FIXED64,
-		descriptor.FieldDescriptorProto_TYPE_FIXED32,
-		descriptor.FieldDescriptorProto_TYPE_UINT32,
-		descriptor.FieldDescriptorProto_TYPE_SFIXED32,
-		descriptor.FieldDescriptorProto_TYPE_SFIXED64,
-		descriptor.FieldDescriptorProto_TYPE_SINT32,
-		descriptor.FieldDescriptorProto_TYPE_SINT64:
+	case descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+		descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+		descriptorpb.FieldDescriptorProto_TYPE_INT64,
+		descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+		descriptorpb.FieldDescriptorProto_TYPE_INT32,
+		descriptorpb.FieldDescriptorProto_TYPE_FIXED64,
+		descriptorpb.FieldDescriptorProto_TYPE_FIXED32,
+		descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+		descriptorpb.FieldDescriptorProto_TYPE_SFIXED32,
+		descriptorpb.FieldDescriptorProto_TYPE_SFIXED64,
+		descriptorpb.FieldDescriptorProto_TYPE_SINT32,
+		descriptorpb.FieldDescriptorProto_TYPE_SINT64:
 		result = "number"
-	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+	case descriptorpb.FieldDescriptorProto_TYPE_BOOL:
 		result = "boolean"
-	case descriptor.FieldDescriptorProto_TYPE_STRING:
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING:
 		result = "string"
 	default:
 		if isTimestamp(field.GetTypeName()) {
@@ -249,6 +997,8 @@ func getTypeScriptType(message *descriptor.DescriptorProto, field *descriptor.Fi
 			key := fields[0]
 			value := fields[1]
 			result = fmt.Sprintf("{ [name: %s]: %s }", getTypeScriptType(msg, key), getTypeScriptType(msg, value))
+		} else if name, ok := enumNames[field.GetTypeName()]; ok {
+			result = name
 		} else {
 			parts := strings.Split(field.GetTypeName(), ".")
 			result = parts[len(parts)-1]
@@ -257,10 +1007,13 @@ func getTypeScriptType(message *descriptor.DescriptorProto, field *descriptor.Fi
 	if isRepeated(field.GetLabel()) && !isMap(field.GetTypeName()) {
 		result += "[]"
 	}
+	if field.GetProto3Optional() {
+		result += " | undefined"
+	}
 	return result
 }
 
-func initiate(message *descriptor.DescriptorProto, field *descriptor.FieldDescriptorProto) string {
+func initiate(message *descriptorpb.DescriptorProto, field *descriptorpb.FieldDescriptorProto) string {
 	// object string: custom Type, e.g. stats: { [name: string]: Stats }
 	if isMap(field.GetTypeName()) {
 		msg := message.GetNestedType()[0]
@@ -272,6 +1025,14 @@ func initiate(message *descriptor.DescriptorProto, field *descriptor.FieldDescri
 	if isRepeated(field.GetLabel()) {
 		return fmt.Sprintf("this.%s = o.%s || []", field.GetName(), field.GetName())
 	}
+	// proto3 `optional`: keep absent/null distinguishable from the zero value
+	if field.GetProto3Optional() {
+		if isMessage(field.GetType()) {
+			parts := strings.Split(field.GetTypeName(), ".")
+			return fmt.Sprintf("this.%s = o.%s !== undefined ? new %s(o.%s) : undefined", field.GetName(), field.GetName(), parts[len(parts)-1], field.GetName())
+		}
+		return fmt.Sprintf("this.%s = o.%s", field.GetName(), field.GetName())
+	}
 	// timestamp
 	if isTimestamp(field.GetTypeName()) {
 		return fmt.Sprintf("this.%s = o.%s || \"\"", field.GetName(), field.GetName())
@@ -285,12 +1046,294 @@ func initiate(message *descriptor.DescriptorProto, field *descriptor.FieldDescri
 	return fmt.Sprintf("this.%s = o.%s || %s", field.GetName(), field.GetName(), zv(field.GetType()))
 }
 
-func isRepeated(label descriptor.FieldDescriptorProto_Label) bool {
-	return label == descriptor.FieldDescriptorProto_LABEL_REPEATED
+// protobuf wire types, see
+// https://developers.google.com/protocol-buffers/docs/encoding#structure
+const (
+	wireVarint = 0
+	wire64bit  = 1
+	wireBytes  = 2
+	wire32bit  = 5
+)
+
+func fieldWireType(field *descriptorpb.FieldDescriptorProto) int {
+	switch field.GetType() {
+	case descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+		descriptorpb.FieldDescriptorProto_TYPE_FIXED64,
+		descriptorpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return wire64bit
+	case descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+		descriptorpb.FieldDescriptorProto_TYPE_FIXED32,
+		descriptorpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return wire32bit
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING,
+		descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+		descriptorpb.FieldDescriptorProto_TYPE_MESSAGE:
+		return wireBytes
+	default:
+		return wireVarint
+	}
+}
+
+func fieldTag(field *descriptorpb.FieldDescriptorProto) int {
+	return int(field.GetNumber())<<3 | fieldWireType(field)
+}
+
+// writeExpr returns the TwirpWriter call that writes expr (a single
+// value, not a repeated field) for field's type.
+func writeExpr(field *descriptorpb.FieldDescriptorProto, expr string) string {
+	return writeExprOn(field, "w", expr)
+}
+
+// writeExprOn is writeExpr against an arbitrary TwirpWriter expression,
+// used when the value is written to a sub-writer rather than encode()'s
+// local `w` (e.g. a packed-repeated blob or a map entry's own writer).
+func writeExprOn(field *descriptorpb.FieldDescriptorProto, writer, expr string) string {
+	switch field.GetType() {
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING:
+		return fmt.Sprintf("%s.writeString(%s)", writer, expr)
+	case descriptorpb.FieldDescriptorProto_TYPE_BYTES:
+		return fmt.Sprintf("%s.writeBytes(%s)", writer, expr)
+	case descriptorpb.FieldDescriptorProto_TYPE_MESSAGE:
+		return fmt.Sprintf("%s.writeBytes(%s.encode())", writer, expr)
+	case descriptorpb.FieldDescriptorProto_TYPE_BOOL:
+		return fmt.Sprintf("%s.writeVarint(%s ? 1 : 0)", writer, expr)
+	case descriptorpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return fmt.Sprintf("%s.writeDouble(%s)", writer, expr)
+	case descriptorpb.FieldDescriptorProto_TYPE_FLOAT:
+		return fmt.Sprintf("%s.writeFloat(%s)", writer, expr)
+	case descriptorpb.FieldDescriptorProto_TYPE_FIXED64:
+		return fmt.Sprintf("%s.writeFixed64(%s)", writer, expr)
+	case descriptorpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return fmt.Sprintf("%s.writeSfixed64(%s)", writer, expr)
+	case descriptorpb.FieldDescriptorProto_TYPE_FIXED32:
+		return fmt.Sprintf("%s.writeFixed32(%s)", writer, expr)
+	case descriptorpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return fmt.Sprintf("%s.writeSfixed32(%s)", writer, expr)
+	case descriptorpb.FieldDescriptorProto_TYPE_SINT32, descriptorpb.FieldDescriptorProto_TYPE_SINT64:
+		return fmt.Sprintf("%s.writeZigzag(%s)", writer, expr)
+	default:
+		return fmt.Sprintf("%s.writeVarint(%s)", writer, expr)
+	}
+}
+
+// readExpr returns the TwirpReader call that reads a single value of
+// field's type off the wire. INT32/INT64 go through the signed varint
+// reader (the wire carries their two's-complement 64-bit form);
+// SINT32/SINT64 are zigzag-encoded; everything else that falls to
+// readVarint (UINT32/UINT64/ENUM) is read as unsigned.
+func readExpr(field *descriptorpb.FieldDescriptorProto) string {
+	return readExprOn(field, "r")
+}
+
+// readExprOn is readExpr against an arbitrary TwirpReader expression,
+// used when the value is read off a sub-reader rather than the
+// decode()-local `r` (e.g. a map entry's own length-delimited reader).
+func readExprOn(field *descriptorpb.FieldDescriptorProto, reader string) string {
+	switch field.GetType() {
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING:
+		return fmt.Sprintf("%s.readString()", reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_BYTES:
+		return fmt.Sprintf("%s.readBytes()", reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_MESSAGE:
+		parts := strings.Split(field.GetTypeName(), ".")
+		return fmt.Sprintf("%s.decode(%s.readBytes())", parts[len(parts)-1], reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_BOOL:
+		return fmt.Sprintf("%s.readVarint() !== 0", reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return fmt.Sprintf("%s.readDouble()", reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_FLOAT:
+		return fmt.Sprintf("%s.readFloat()", reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_FIXED64:
+		return fmt.Sprintf("%s.readFixed64()", reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return fmt.Sprintf("%s.readSfixed64()", reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_FIXED32:
+		return fmt.Sprintf("%s.readFixed32()", reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_SFIXED32:
+		return fmt.Sprintf("%s.readSfixed32()", reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_INT32, descriptorpb.FieldDescriptorProto_TYPE_INT64:
+		return fmt.Sprintf("%s.readSignedVarint()", reader)
+	case descriptorpb.FieldDescriptorProto_TYPE_SINT32, descriptorpb.FieldDescriptorProto_TYPE_SINT64:
+		return fmt.Sprintf("%s.readZigzag()", reader)
+	default:
+		return fmt.Sprintf("%s.readVarint()", reader)
+	}
+}
+
+// isPackable reports whether field's wire type is eligible for proto3's
+// default packed encoding (varint/32-bit/64-bit scalars). STRING/BYTES/
+// MESSAGE are always length-delimited per element and are never packed.
+func isPackable(field *descriptorpb.FieldDescriptorProto) bool {
+	return fieldWireType(field) != wireBytes
+}
+
+// encodeField generates the TS statement(s) that write a single field of
+// {{.Message.GetName}} onto a TwirpWriter inside encode().
+func encodeField(message *descriptorpb.DescriptorProto, field *descriptorpb.FieldDescriptorProto) string {
+	name := field.GetName()
+	tag := fieldTag(field)
+
+	// map<K, V> fields are descriptor-level `repeated` messages of a
+	// synthetic KVEntry type; they need their own key/value wire layout
+	// rather than the plain repeated-message path below.
+	if isMap(field.GetTypeName()) {
+		entry := message.GetNestedType()[0]
+		key := entry.GetField()[0]
+		value := entry.GetField()[1]
+		return fmt.Sprintf(`for (const [k, v] of Object.entries(this.%s)) {
+      w.writeVarint(%d)
+      const entry = new TwirpWriter()
+      entry.writeVarint(%d); %s
+      entry.writeVarint(%d); %s
+      w.writeBytes(entry.finish())
+    }`, name, tag, fieldTag(key), writeExpr(key, mapKeyExpr(key, "k")), fieldTag(value), writeExpr(value, "v"))
+	}
+	if isRepeated(field.GetLabel()) {
+		// proto3 packs repeated scalars into one length-delimited blob by
+		// default; repeated messages/strings/bytes stay one tag per element.
+		if isPackable(field) {
+			return fmt.Sprintf(`{
+      const packed = new TwirpWriter()
+      for (const v of this.%s) { %s }
+      w.writeVarint(%d)
+      w.writeBytes(packed.finish())
+    }`, name, writeExprOn(field, "packed", "v"), tag)
+		}
+		return fmt.Sprintf("for (const v of this.%s) { w.writeVarint(%d); %s }", name, tag, writeExpr(field, "v"))
+	}
+	// proto3 `optional`: an absent value must stay absent on the wire,
+	// not get encoded as a present zero value.
+	if field.GetProto3Optional() {
+		return fmt.Sprintf("if (this.%s !== undefined) { const v = this.%s; w.writeVarint(%d); %s }", name, name, tag, writeExpr(field, "v"))
+	}
+	return fmt.Sprintf("{ const v = this.%s; w.writeVarint(%d); %s }", name, tag, writeExpr(field, "v"))
+}
+
+// mapKeyExpr coerces a map key (always a string once it has passed
+// through Object.entries, since JS object keys are stringified) back to
+// the wire type that its proto key actually is.
+func mapKeyExpr(key *descriptorpb.FieldDescriptorProto, expr string) string {
+	switch key.GetType() {
+	case descriptorpb.FieldDescriptorProto_TYPE_STRING:
+		return expr
+	case descriptorpb.FieldDescriptorProto_TYPE_BOOL:
+		return fmt.Sprintf("%s === 'true'", expr)
+	default:
+		return fmt.Sprintf("Number(%s)", expr)
+	}
+}
+
+// decodeField generates the `case` clause inside decode()'s switch over
+// field numbers that reads a single field of {{.Message.GetName}}.
+func decodeField(message *descriptorpb.DescriptorProto, field *descriptorpb.FieldDescriptorProto) string {
+	name := field.GetName()
+	num := field.GetNumber()
+	read := readExpr(field)
+
+	if isMap(field.GetTypeName()) {
+		entry := message.GetNestedType()[0]
+		key := entry.GetField()[0]
+		value := entry.GetField()[1]
+		return fmt.Sprintf(`case %d: {
+      if (!o.%s) { o.%s = {} }
+      const er = new TwirpReader(r.readBytes())
+      let k: any, v: any
+      while (er.hasMore()) {
+        const entryTag = er.readVarint()
+        switch (entryTag >>> 3) {
+          case %d: k = %s; break
+          case %d: v = %s; break
+          default: er.skip(entryTag & 7)
+        }
+      }
+      o.%s[k] = v
+      break
+    }`, num, name, name, key.GetNumber(), readExprOn(key, "er"), value.GetNumber(), readExprOn(value, "er"), name)
+	}
+	if isRepeated(field.GetLabel()) {
+		// proto3 encoders pack repeated scalars by default (one tag,
+		// length-delimited, back-to-back values), but the legacy one-
+		// tag-per-value form is still valid on the wire; accept both.
+		if isPackable(field) {
+			return fmt.Sprintf(`case %d: {
+      if (!o.%s) { o.%s = [] }
+      if ((tag & 7) === %d) {
+        o.%s.push(%s)
+      } else {
+        o.%s.push(...r.readPacked(() => %s))
+      }
+      break
+    }`, num, name, name, fieldWireType(field), name, read, name, read)
+		}
+		return fmt.Sprintf("case %d: { if (!o.%s) { o.%s = [] }; o.%s.push(%s); break }", num, name, name, name, read)
+	}
+	return fmt.Sprintf("case %d: o.%s = %s; break", num, name, read)
+}
+
+// oneofEncode generates the switch over a discriminated union's `kind`
+// that writes whichever alternative is currently set.
+func oneofEncode(message *descriptorpb.DescriptorProto, group OneofGroup) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "switch (this.%s.kind) {\n", group.Name)
+	for _, field := range group.Fields {
+		access := fmt.Sprintf("this.%s.%s", group.Name, field.GetName())
+		fmt.Fprintf(&b, "      case '%s': { w.writeVarint(%d); %s; break }\n", field.GetName(), fieldTag(field), writeExpr(field, access))
+	}
+	b.WriteString("    }")
+	return b.String()
+}
+
+// decodeOneofField generates the `case` clause that reconstructs a
+// discriminated union from a single wire field belonging to oneofName.
+func decodeOneofField(message *descriptorpb.DescriptorProto, oneofName string, field *descriptorpb.FieldDescriptorProto) string {
+	name := field.GetName()
+	return fmt.Sprintf("case %d: o.%s = { kind: '%s', %s: %s }; break", field.GetNumber(), oneofName, name, name, readExpr(field))
+}
+
+// oneofInit generates the constructor logic that picks whichever
+// alternative is present on the input object.
+func oneofInit(message *descriptorpb.DescriptorProto, group OneofGroup) string {
+	var b strings.Builder
+	for i, field := range group.Fields {
+		name := field.GetName()
+		value := oneofValueExpr(field, fmt.Sprintf("o.%s", name))
+		if i == 0 {
+			fmt.Fprintf(&b, "if (o.%s !== undefined) { this.%s = { kind: '%s', %s: %s } }\n", name, group.Name, name, name, value)
+		} else {
+			fmt.Fprintf(&b, "    else if (o.%s !== undefined) { this.%s = { kind: '%s', %s: %s } }\n", name, group.Name, name, name, value)
+		}
+	}
+	first := group.Fields[0]
+	fmt.Fprintf(&b, "    else { this.%s = { kind: '%s', %s: %s } }", group.Name, first.GetName(), first.GetName(), zvOrMessage(first))
+	return b.String()
+}
+
+// oneofValueExpr wraps a oneof alternative's raw input in its
+// constructor when it is a message type, matching initiate().
+func oneofValueExpr(field *descriptorpb.FieldDescriptorProto, access string) string {
+	if isMessage(field.GetType()) {
+		parts := strings.Split(field.GetTypeName(), ".")
+		return fmt.Sprintf("new %s(%s || {})", parts[len(parts)-1], access)
+	}
+	return access
+}
+
+// zvOrMessage returns the default value for a oneof alternative that is
+// selected when none of the input's keys is present.
+func zvOrMessage(field *descriptorpb.FieldDescriptorProto) string {
+	if isMessage(field.GetType()) {
+		parts := strings.Split(field.GetTypeName(), ".")
+		return fmt.Sprintf("new %s({})", parts[len(parts)-1])
+	}
+	return zv(field.GetType())
+}
+
+func isRepeated(label descriptorpb.FieldDescriptorProto_Label) bool {
+	return label == descriptorpb.FieldDescriptorProto_LABEL_REPEATED
 }
 
-func isMessage(t descriptor.FieldDescriptorProto_Type) bool {
-	return t == descriptor.FieldDescriptorProto_TYPE_MESSAGE
+func isMessage(t descriptorpb.FieldDescriptorProto_Type) bool {
+	return t == descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
 }
 
 func isMap(typeName string) bool {
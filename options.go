@@ -0,0 +1,50 @@
+package main
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// streamExtensionField is the field number of the `stream` extension
+// declared in twirp_es.proto:
+//
+//	extend google.protobuf.MethodOptions {
+//	  bool stream = 50000;
+//	}
+//
+// A method annotated with `option (twirp_es.stream) = true;` is
+// generated as an async iterator (see streamMethod) instead of a single
+// request/response function.
+const streamExtensionField = 50000
+
+// isStreaming reports whether method is annotated with
+// `option (twirp_es.stream) = true;`. twirp_es.proto isn't compiled into
+// a generated extension, so the option is read straight off the
+// unrecognized bytes of MethodOptions instead of through proto.GetExtension.
+func isStreaming(method *descriptorpb.MethodDescriptorProto) bool {
+	opts := method.GetOptions()
+	if opts == nil {
+		return false
+	}
+	b := opts.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return false
+		}
+		b = b[n:]
+		if num == streamExtensionField && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return false
+			}
+			return v != 0
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return false
+		}
+		b = b[n:]
+	}
+	return false
+}